@@ -0,0 +1,423 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	aeadNonceSize = 12
+	aeadTagSize   = 16
+
+	rekeyFlagIndex = 0
+	rekeyFlagMask  = 0x02
+)
+
+// aeadTagOffset is the offset of the authentication tag within a block's
+// reserved flags area. It is computed once, at package init, so that a
+// structs.h built with too small a flags reservation fails loudly instead
+// of silently truncating tags.
+var aeadTagOffset = blockFlagsSize - aeadTagSize
+
+func init() {
+	if aeadTagOffset < 1 {
+		panic("shm: blockFlagsSize is too small to hold an AEAD tag")
+	}
+}
+
+// AEADReadWriteCloser wraps a ReadWriteCloser, encrypting and
+// authenticating every block with an AEAD cipher (AES-256-GCM by default).
+// The nonce for each block is derived deterministically from the block's
+// index and a monotonic send counter, so it is never reused for a given
+// key; long-lived channels should call Rekey periodically instead of
+// relying on the nonce space alone.
+//
+// Read, Write, ReadFrom and WriteTo are all reimplemented here rather than
+// inherited from the embedded ReadWriteCloser: Go has no virtual dispatch,
+// so the embedded versions would call the embedded GetReadBuffer/
+// SendWriteBuffer directly and bypass encryption entirely.
+type AEADReadWriteCloser struct {
+	*ReadWriteCloser
+
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	sendAEAD cipher.AEAD
+	sendKey  [32]byte
+	sendCtr  uint64
+	rekeyNow uint32 // set atomically by Rekey
+
+	recvAEAD cipher.AEAD
+	recvKey  [32]byte
+	recvCtr  uint64
+}
+
+// aeadDirection selects which of the two HKDF-derived keys a duplex
+// AEADReadWriteCloser uses to send and which it uses to receive, so the
+// two directions of a duplex channel never encrypt with the same (key,
+// nonce) pair even though both start their per-direction counters at 0.
+// A simplex channel carries data in one direction only and so has no
+// collision to avoid; it uses the raw key for both (only one of the two
+// ever gets used).
+type aeadDirection int
+
+const (
+	aeadSimplex aeadDirection = iota
+	aeadInitiator
+	aeadResponder
+)
+
+const (
+	aeadInitiatorInfo = "shm-go aead initiator->responder"
+	aeadResponderInfo = "shm-go aead responder->initiator"
+)
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// hkdfExpand derives a 32-byte key from key, labelled by info, using
+// HKDF-SHA256 with no salt.
+func hkdfExpand(key [32]byte, info string) ([32]byte, error) {
+	var out [32]byte
+
+	r := hkdf.New(sha256.New, key[:], nil, []byte(info))
+	if _, err := io.ReadFull(r, out[:]); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+func newAEADReadWriteCloser(rw *ReadWriteCloser, key [32]byte, dir aeadDirection) (*AEADReadWriteCloser, error) {
+	a := &AEADReadWriteCloser{
+		ReadWriteCloser: rw,
+		newAEAD:         newAESGCM,
+	}
+
+	switch dir {
+	case aeadSimplex:
+		a.sendKey, a.recvKey = key, key
+	case aeadInitiator:
+		sendKey, err := hkdfExpand(key, aeadInitiatorInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		recvKey, err := hkdfExpand(key, aeadResponderInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		a.sendKey, a.recvKey = sendKey, recvKey
+	case aeadResponder:
+		sendKey, err := hkdfExpand(key, aeadResponderInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		recvKey, err := hkdfExpand(key, aeadInitiatorInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		a.sendKey, a.recvKey = sendKey, recvKey
+	}
+
+	var err error
+	if a.sendAEAD, err = a.newAEAD(a.sendKey[:]); err != nil {
+		return nil, err
+	}
+
+	if a.recvAEAD, err = a.newAEAD(a.recvKey[:]); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// CreateDuplexAEAD creates a duplex shared memory channel and wraps it in
+// an AEADReadWriteCloser using key. Both peers must call CreateDuplexAEAD
+// or OpenDuplexAEAD with the same key, negotiated out-of-band; each side
+// calling its own function is what lets the two directions derive
+// distinct send/receive keys from the shared key.
+func CreateDuplexAEAD(name string, blockCount, blockSize uint64, key [32]byte) (*AEADReadWriteCloser, error) {
+	rw, err := CreateDuplex(name, blockCount, blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADReadWriteCloser(rw, key, aeadInitiator)
+}
+
+// OpenDuplexAEAD opens a duplex shared memory channel created with
+// CreateDuplexAEAD and wraps it in an AEADReadWriteCloser using key.
+func OpenDuplexAEAD(name string, key [32]byte) (*AEADReadWriteCloser, error) {
+	rw, err := OpenDuplex(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADReadWriteCloser(rw, key, aeadResponder)
+}
+
+// CreateSimplexAEAD creates a simplex shared memory channel and wraps it in
+// an AEADReadWriteCloser using key.
+func CreateSimplexAEAD(name string, blockCount, blockSize uint64, key [32]byte) (*AEADReadWriteCloser, error) {
+	rw, err := CreateSimplex(name, blockCount, blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADReadWriteCloser(rw, key, aeadSimplex)
+}
+
+// OpenSimplexAEAD opens a simplex shared memory channel created with
+// CreateSimplexAEAD and wraps it in an AEADReadWriteCloser using key.
+func OpenSimplexAEAD(name string, key [32]byte) (*AEADReadWriteCloser, error) {
+	rw, err := OpenSimplex(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEADReadWriteCloser(rw, key, aeadSimplex)
+}
+
+// Rekey schedules an HKDF-based key ratchet: the next block sent will be
+// encrypted with the current key but flagged so the peer derives the next
+// key before reading the block after it, and the sender rotates to the
+// same derived key immediately after sending.
+func (a *AEADReadWriteCloser) Rekey() {
+	atomic.StoreUint32(&a.rekeyNow, 1)
+}
+
+func ratchet(key [32]byte) ([32]byte, error) {
+	var next [32]byte
+
+	r := hkdf.New(sha256.New, key[:], nil, []byte("shm-go rekey"))
+	if _, err := io.ReadFull(r, next[:]); err != nil {
+		return next, err
+	}
+
+	return next, nil
+}
+
+func blockNonce(blockIndex uint32, counter uint64) [aeadNonceSize]byte {
+	var nonce [aeadNonceSize]byte
+	binary.BigEndian.PutUint32(nonce[:4], blockIndex)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// GetWriteBuffer is like ReadWriteCloser.GetWriteBuffer, but reserves
+// aeadTagSize bytes of the block's capacity for the tag SendWriteBuffer
+// will append. Without this, filling buf.Data out to its full underlying
+// capacity (as Write and ReadFrom do) would make Seal grow the result
+// past the block and reallocate on the heap, silently orphaning the
+// actual shm block instead of encrypting into it.
+func (a *AEADReadWriteCloser) GetWriteBuffer() (Buffer, error) {
+	buf, err := a.ReadWriteCloser.GetWriteBuffer()
+	if err != nil {
+		return Buffer{}, err
+	}
+
+	if cap(buf.Data) > aeadTagSize {
+		buf.Data = buf.Data[:0:cap(buf.Data)-aeadTagSize]
+	}
+
+	return buf, nil
+}
+
+// GetReadBuffer decrypts the next block in place and returns a Buffer
+// whose Data is the verified plaintext. It returns ErrAuthFailed if the
+// block's tag does not verify.
+func (a *AEADReadWriteCloser) GetReadBuffer() (Buffer, error) {
+	buf, err := a.ReadWriteCloser.GetReadBuffer()
+	if err != nil {
+		return Buffer{}, err
+	}
+
+	// The ring is strictly FIFO, so the receiver's Nth block observes the
+	// same send counter the sender used for its Nth block.
+	counter := a.recvCtr
+	a.recvCtr++
+
+	nonce := blockNonce(buf.index, counter)
+
+	tag := buf.Flags[aeadTagOffset : aeadTagOffset+aeadTagSize]
+	ciphertext := append(buf.Data, tag...)
+
+	plaintext, err := a.recvAEAD.Open(buf.Data[:0], nonce[:], ciphertext, nil)
+	if err != nil {
+		return Buffer{}, ErrAuthFailed
+	}
+
+	buf.Data = plaintext
+
+	if buf.Flags[rekeyFlagIndex]&rekeyFlagMask != 0 {
+		next, err := ratchet(a.recvKey)
+		if err != nil {
+			return Buffer{}, err
+		}
+
+		if a.recvAEAD, err = a.newAEAD(next[:]); err != nil {
+			return Buffer{}, err
+		}
+
+		a.recvKey = next
+	}
+
+	return buf, nil
+}
+
+// SendWriteBuffer encrypts buf.Data in place with the current send key,
+// writes the authentication tag into the block's reserved flags area and
+// publishes the block.
+func (a *AEADReadWriteCloser) SendWriteBuffer(buf Buffer) (int, error) {
+	counter := a.sendCtr
+	a.sendCtr++
+
+	nonce := blockNonce(buf.index, counter)
+
+	n := len(buf.Data)
+
+	// Seal into the block's full-capacity backing slice, not buf.Data[:0]:
+	// GetWriteBuffer already shrank buf.Data's capacity by aeadTagSize so
+	// the caller can't fill past blockSize-aeadTagSize, but Seal's own
+	// destination still needs room for the tag it appends. Sealing into
+	// the shrunk-capacity slice would make Seal reallocate on the heap for
+	// any plaintext over blockSize-2*aeadTagSize, leaving the shm block
+	// holding stale plaintext and discarding the real ciphertext.
+	sealed := a.sendAEAD.Seal(buf.Bytes()[:0], nonce[:], buf.Data, nil)
+
+	copy(buf.Flags[aeadTagOffset:aeadTagOffset+aeadTagSize], sealed[n:])
+	buf.Data = sealed[:n]
+
+	if atomic.CompareAndSwapUint32(&a.rekeyNow, 1, 0) {
+		buf.Flags[rekeyFlagIndex] |= rekeyFlagMask
+
+		next, err := ratchet(a.sendKey)
+		if err != nil {
+			return 0, err
+		}
+
+		if a.sendAEAD, err = a.newAEAD(next[:]); err != nil {
+			return 0, err
+		}
+
+		a.sendKey = next
+	} else {
+		buf.Flags[rekeyFlagIndex] &^= rekeyFlagMask
+	}
+
+	return a.ReadWriteCloser.SendWriteBuffer(buf)
+}
+
+// Read decrypts and copies the next block into p. It calls a.GetReadBuffer
+// and a.SendReadBuffer rather than the plaintext ones promoted from the
+// embedded ReadWriteCloser, so callers going through io.Reader (io.Copy,
+// net.Conn, http bodies, ...) still get authenticated decryption.
+func (a *AEADReadWriteCloser) Read(p []byte) (n int, err error) {
+	buf, err := a.GetReadBuffer()
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(p, buf.Data)
+	isEOF := buf.Flags[eofFlagIndex]&eofFlagMask != 0
+
+	if err = a.SendReadBuffer(buf); err != nil {
+		return n, err
+	}
+
+	if isEOF {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteTo decrypts and writes every remaining block to w.
+func (a *AEADReadWriteCloser) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		buf, err := a.GetReadBuffer()
+		if err != nil {
+			return n, err
+		}
+
+		nn, err := w.Write(buf.Data)
+		n += int64(nn)
+
+		isEOF := buf.Flags[eofFlagIndex]&eofFlagMask != 0
+
+		if putErr := a.SendReadBuffer(buf); putErr != nil {
+			return n, putErr
+		}
+
+		if err != nil || isEOF {
+			return n, err
+		}
+	}
+}
+
+// Write encrypts and sends p as a single block.
+func (a *AEADReadWriteCloser) Write(p []byte) (n int, err error) {
+	buf, err := a.GetWriteBuffer()
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(buf.Data[:cap(buf.Data)], p)
+	buf.Data = buf.Data[:n]
+
+	buf.Flags[eofFlagIndex] |= eofFlagMask
+
+	_, err = a.SendWriteBuffer(buf)
+	return n, err
+}
+
+// ReadFrom reads r to completion, encrypting and sending one block per
+// Read.
+func (a *AEADReadWriteCloser) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		buf, err := a.GetWriteBuffer()
+		if err != nil {
+			return n, err
+		}
+
+		nn, err := r.Read(buf.Data[:cap(buf.Data)])
+		buf.Data = buf.Data[:nn]
+		n += int64(nn)
+
+		if err == io.EOF {
+			buf.Flags[eofFlagIndex] |= eofFlagMask
+		} else {
+			buf.Flags[eofFlagIndex] &^= eofFlagMask
+		}
+
+		if _, putErr := a.SendWriteBuffer(buf); putErr != nil {
+			return n, err
+		}
+
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
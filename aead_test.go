@@ -0,0 +1,106 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import "testing"
+
+func TestAEADDirectionalKeysDontCollide(t *testing.T) {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	initiator := &AEADReadWriteCloser{newAEAD: newAESGCM}
+	responder := &AEADReadWriteCloser{newAEAD: newAESGCM}
+
+	var err error
+	if initiator.sendKey, err = hkdfExpand(key, aeadInitiatorInfo); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.recvKey, err = hkdfExpand(key, aeadResponderInfo); err != nil {
+		t.Fatal(err)
+	}
+	if responder.sendKey, err = hkdfExpand(key, aeadResponderInfo); err != nil {
+		t.Fatal(err)
+	}
+	if responder.recvKey, err = hkdfExpand(key, aeadInitiatorInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	if initiator.sendKey != responder.recvKey {
+		t.Fatal("initiator's send key must equal responder's receive key")
+	}
+
+	if responder.sendKey != initiator.recvKey {
+		t.Fatal("responder's send key must equal initiator's receive key")
+	}
+
+	if initiator.sendKey == initiator.recvKey {
+		t.Fatal("a duplex peer's send and receive keys must differ, or both directions share a (key, nonce) space")
+	}
+}
+
+func TestAEADGetWriteBufferReservesTagSpace(t *testing.T) {
+	a := &AEADReadWriteCloser{ReadWriteCloser: newLoopbackRing(t, 1, 64)}
+
+	buf, err := a.GetWriteBuffer()
+	if err != nil {
+		t.Fatalf("GetWriteBuffer: %v", err)
+	}
+
+	if got, want := cap(buf.Data), 64-aeadTagSize; got != want {
+		t.Fatalf("reserved capacity = %d, want %d", got, want)
+	}
+}
+
+// TestAEADSendWriteBufferSealsNearFullBlockWithoutReallocating exercises a
+// plaintext that fills buf.Data out to the full capacity GetWriteBuffer
+// reserves (blockSize-aeadTagSize). Sealing into that same
+// reduced-capacity slice (rather than the full-capacity block backing it)
+// would force Seal to grow onto the heap, leaving the shm block holding
+// stale plaintext instead of the real ciphertext.
+func TestAEADSendWriteBufferSealsNearFullBlockWithoutReallocating(t *testing.T) {
+	const blockSize = 64
+
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	a, err := newAEADReadWriteCloser(newLoopbackRing(t, 1, blockSize), key, aeadSimplex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := a.GetWriteBuffer()
+	if err != nil {
+		t.Fatalf("GetWriteBuffer: %v", err)
+	}
+
+	plaintext := make([]byte, cap(buf.Data))
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	buf.Data = append(buf.Data[:0], plaintext...)
+
+	if _, err := a.SendWriteBuffer(buf); err != nil {
+		t.Fatalf("SendWriteBuffer: %v", err)
+	}
+
+	// Had Seal reallocated, the block would still hold the plaintext.
+	if string(buf.Bytes()[:len(plaintext)]) == string(plaintext) {
+		t.Fatal("Seal reallocated instead of writing into the block's backing array")
+	}
+
+	got, err := a.GetReadBuffer()
+	if err != nil {
+		t.Fatalf("GetReadBuffer failed on a near-full sealed block: %v", err)
+	}
+
+	if string(got.Data) != string(plaintext) {
+		t.Fatal("round-tripped plaintext does not match what was sealed")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Bytes returns the slice backing buf rooted directly in the shared memory
+// block, without the bounds-checked re-slicing GetReadBuffer/GetWriteBuffer
+// perform on Data. It is intended for callers that already know the block's
+// capacity and want to avoid the extra slice header on the hot path. Unlike
+// Data, it is always exactly the block's capacity, not the current logical
+// size - it never aliases outside that block.
+func (buf *Buffer) Bytes() []byte {
+	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(buf.block)) + blockHeaderSize))
+	return data[:buf.blockSize:buf.blockSize]
+}
+
+// AcquireBuffers reserves up to n contiguous write blocks with a single CAS
+// advance of WriteStart, so a caller publishing many blocks at once (see
+// WritevBuffers) pays the write-side semaphore wait at most once instead of
+// once per block. It may return fewer than n buffers if the ring does not
+// have n free blocks available right now; it never blocks once at least one
+// block is free.
+func (rw *ReadWriteCloser) AcquireBuffers(n int) ([]Buffer, error) {
+	return rw.acquireBuffers(n, nil)
+}
+
+// AcquireBuffersInto is like AcquireBuffers, but appends the reserved
+// buffers to a slice drawn from set instead of allocating a fresh one, so
+// a caller streaming many batches through the same BufferSet amortizes
+// the []Buffer allocation across calls. Pass the result to set.Put once
+// WritevBuffers is done with it.
+func (rw *ReadWriteCloser) AcquireBuffersInto(set *BufferSet, n int) ([]Buffer, error) {
+	return rw.acquireBuffers(n, set)
+}
+
+func (rw *ReadWriteCloser) acquireBuffers(n int, set *BufferSet) ([]Buffer, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return nil, io.ErrClosedPipe
+	}
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	blocks := uintptr(unsafe.Pointer(rw.writeShared)) + sharedHeaderSize
+
+	for {
+		if atomic.LoadUint32(&rw.closed) != 0 {
+			return nil, io.ErrClosedPipe
+		}
+
+		start := atomic.LoadUint32((*uint32)(&rw.writeShared.WriteStart))
+		if start > uint32(rw.writeShared.BlockCount) {
+			return nil, ErrInvalidSharedMemory
+		}
+
+		readEnd := atomic.LoadUint32((*uint32)(&rw.writeShared.ReadEnd))
+
+		indices := make([]uint32, 0, n)
+
+		cur := start
+		for len(indices) < n {
+			block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(cur)*rw.fullBlockSize)))
+			if uint32(block.Next) == readEnd {
+				break
+			}
+
+			indices = append(indices, cur)
+			cur = uint32(block.Next)
+		}
+
+		if len(indices) == 0 {
+			avail := newWaiter(unsafe.Pointer(&rw.writeShared.SemAvail))
+			if err := waitSemaphore(&rw.writeAvailRelay, avail, rw.loadWriteDeadline(), nil); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if !atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteStart), start, cur) {
+			continue
+		}
+
+		var bufs []Buffer
+		if set != nil {
+			bufs = set.Get()
+		} else {
+			bufs = make([]Buffer, 0, len(indices))
+		}
+
+		for _, index := range indices {
+			block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(index)*rw.fullBlockSize)))
+			flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+
+			bufs = append(bufs, Buffer{
+				block:     block,
+				index:     index,
+				write:     true,
+				blockSize: rw.writeShared.BlockSize,
+
+				Data:  buf2data(block)[:0:rw.writeShared.BlockSize],
+				Flags: flags,
+			})
+		}
+
+		return bufs, nil
+	}
+}
+
+// prepareBlockForPublish records buf's logical size on its block and
+// brings the block's sparse/EOF flag bits in line with buf before
+// publishing. A block reused from an earlier send keeps whatever those
+// bits were left as; without this a stale sparse bit would make the next
+// reader substitute zeros() for real data, and a stale EOF bit would
+// surface a spurious mid-stream EOF. WritevBuffers has no per-buffer EOF
+// signal of its own - that's what the single-block GetWriteBuffer/
+// SendWriteBuffer path is for - so it always clears it here.
+func prepareBlockForPublish(buf Buffer) {
+	if buf.sparse {
+		*(*uint64)(&buf.block.Size) = buf.sparseLen
+		buf.Flags[sparseFlagIndex] |= sparseFlagMask
+	} else {
+		*(*uint64)(&buf.block.Size) = uint64(len(buf.Data))
+		buf.Flags[sparseFlagIndex] &^= sparseFlagMask
+	}
+
+	buf.Flags[eofFlagIndex] &^= eofFlagMask
+}
+
+func buf2data(block *sharedBlock) *[1 << 30]byte {
+	return (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
+}
+
+// WritevBuffers publishes bufs, which must have been returned by
+// AcquireBuffers on the same ReadWriteCloser, posting the write-side
+// semaphore at most once for the whole batch rather than once per block.
+func (rw *ReadWriteCloser) WritevBuffers(bufs []Buffer) (int, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	for _, buf := range bufs {
+		if !buf.write {
+			return n, ErrInvalidBuffer
+		}
+
+		prepareBlockForPublish(buf)
+
+		atomic.StoreUint32((*uint32)(&buf.block.DoneWrite), 1)
+
+		n += len(buf.Data)
+	}
+
+	blocks := uintptr(unsafe.Pointer(rw.writeShared)) + sharedHeaderSize
+
+	for {
+		blockIndex := atomic.LoadUint32((*uint32)(&rw.writeShared.WriteEnd))
+		if blockIndex > uint32(rw.writeShared.BlockCount) {
+			return n, ErrInvalidSharedMemory
+		}
+
+		block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+
+		if !atomic.CompareAndSwapUint32((*uint32)(&block.DoneWrite), 1, 0) {
+			return n, nil
+		}
+
+		atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteEnd), blockIndex, uint32(block.Next))
+
+		if blockIndex == atomic.LoadUint32((*uint32)(&rw.writeShared.ReadStart)) {
+			if err := newWaiter(unsafe.Pointer(&rw.writeShared.SemSignal)).Post(); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// NextReadBuffers returns up to max already-available read blocks without
+// blocking between them, so a caller draining a backlog pays the read-side
+// semaphore wait at most once instead of once per block. It returns a nil
+// slice, not an error, if no blocks are currently available; callers that
+// want to block should fall back to GetReadBuffer. Every returned Buffer
+// must still be passed to SendReadBuffer once consumed.
+func (rw *ReadWriteCloser) NextReadBuffers(max int) ([]Buffer, error) {
+	if atomic.LoadUint32(&rw.closed) != 0 {
+		return nil, io.ErrClosedPipe
+	}
+
+	if max <= 0 {
+		return nil, nil
+	}
+
+	blocks := uintptr(unsafe.Pointer(rw.readShared)) + sharedHeaderSize
+
+	var bufs []Buffer
+
+	for len(bufs) < max {
+		blockIndex := atomic.LoadUint32((*uint32)(&rw.readShared.ReadStart))
+		if blockIndex > uint32(rw.readShared.BlockCount) {
+			return bufs, ErrInvalidSharedMemory
+		}
+
+		if blockIndex == atomic.LoadUint32((*uint32)(&rw.readShared.WriteEnd)) {
+			break
+		}
+
+		block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
+
+		if !atomic.CompareAndSwapUint32((*uint32)(&rw.readShared.ReadStart), blockIndex, uint32(block.Next)) {
+			continue
+		}
+
+		flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+
+		if flags[sparseFlagIndex]&sparseFlagMask != 0 {
+			bufs = append(bufs, Buffer{
+				block:     block,
+				index:     blockIndex,
+				blockSize: rw.readShared.BlockSize,
+
+				Data:  zeros(block.Size),
+				Flags: flags,
+			})
+
+			continue
+		}
+
+		bufs = append(bufs, Buffer{
+			block:     block,
+			index:     blockIndex,
+			blockSize: rw.readShared.BlockSize,
+
+			Data:  buf2data(block)[:block.Size:rw.readShared.BlockSize],
+			Flags: flags,
+		})
+	}
+
+	return bufs, nil
+}
+
+// BufferSet is a sync.Pool-backed collection of write Buffer slices,
+// reused across calls to AcquireBuffersInto/WritevBuffers so that a
+// caller streaming a large io.Reader can amortize the []Buffer allocation
+// across many batches instead of paying for one per batch.
+type BufferSet struct {
+	pool sync.Pool // of *[]Buffer
+}
+
+// Get returns a []Buffer with zero length, reused from the pool if one is
+// available.
+func (s *BufferSet) Get() []Buffer {
+	if v, ok := s.pool.Get().(*[]Buffer); ok {
+		return (*v)[:0]
+	}
+
+	return nil
+}
+
+// Put returns bufs to the pool for reuse by a later Get. Callers must stop
+// using bufs after calling Put.
+func (s *BufferSet) Put(bufs []Buffer) {
+	bufs = bufs[:0]
+	s.pool.Put(&bufs)
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestBufferSetReusesBackingArray(t *testing.T) {
+	var set BufferSet
+
+	bufs := set.Get()
+	bufs = append(bufs, Buffer{}, Buffer{})
+	set.Put(bufs)
+
+	got := set.Get()
+	if cap(got) < 2 {
+		t.Fatalf("Get after Put did not reuse the backing array: cap = %d, want >= 2", cap(got))
+	}
+
+	if len(got) != 0 {
+		t.Fatalf("Get returned length %d, want 0", len(got))
+	}
+}
+
+func newTestBlock(dataLen int) *sharedBlock {
+	raw := make([]byte, int(blockHeaderSize)+dataLen)
+	return (*sharedBlock)(unsafe.Pointer(&raw[0]))
+}
+
+func TestPrepareBlockForPublishClearsStaleFlags(t *testing.T) {
+	block := newTestBlock(8)
+
+	var flags [blockFlagsSize]byte
+	flags[sparseFlagIndex] |= sparseFlagMask
+	flags[eofFlagIndex] |= eofFlagMask
+
+	buf := Buffer{block: block, write: true, Data: make([]byte, 4), Flags: &flags}
+
+	prepareBlockForPublish(buf)
+
+	if flags[sparseFlagIndex]&sparseFlagMask != 0 {
+		t.Fatal("sparse flag left set on a non-sparse buffer reusing a block published sparse before")
+	}
+
+	if flags[eofFlagIndex]&eofFlagMask != 0 {
+		t.Fatal("EOF flag left set from a block's earlier send")
+	}
+
+	if block.Size != 4 {
+		t.Fatalf("block.Size = %d, want 4", block.Size)
+	}
+}
+
+func TestPrepareBlockForPublishSetsSparseFlagAndLen(t *testing.T) {
+	block := newTestBlock(8)
+
+	var flags [blockFlagsSize]byte
+
+	buf := Buffer{block: block, write: true, sparse: true, sparseLen: 8, Flags: &flags}
+
+	prepareBlockForPublish(buf)
+
+	if flags[sparseFlagIndex]&sparseFlagMask == 0 {
+		t.Fatal("sparse flag not set for a sparse buffer")
+	}
+
+	if block.Size != 8 {
+		t.Fatalf("block.Size = %d, want 8", block.Size)
+	}
+}
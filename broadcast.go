@@ -0,0 +1,300 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	broadcastHeartbeatEvery = 2 * time.Second
+	broadcastStaleAfter     = 3 * broadcastHeartbeatEvery
+	broadcastSendTimeout    = 500 * time.Millisecond
+)
+
+// ErrNoFreeBroadcastSlot is returned by OpenBroadcastReader when every
+// reader slot of a broadcast is already claimed.
+var ErrNoFreeBroadcastSlot = fmt.Errorf("shm: no free broadcast reader slot")
+
+// BroadcastWriter fans a single stream of blocks out to up to maxReaders
+// independent readers, each with its own cursor, by giving every reader
+// slot its own physical duplex ring: one direction carries the broadcast
+// data, the other carries a small heartbeat so a crashed reader's slot can
+// be reclaimed. Readers attach with OpenBroadcastReader.
+//
+// This copies every block into each attached reader's ring rather than
+// having all readers follow independent cursors through one shared ring,
+// which would need sharedMem to carry a per-reader array of
+// ReadStart/ReadEnd/SemSignal cursors instead of a single set. That shape
+// means growing the cgo-generated header (structs.h plus the generated
+// shared_linux_{386,amd64}.go), which this tree does not have checked in;
+// the N-way-copy design here is the one buildable without them. Revisit
+// once the generated header is available.
+type BroadcastWriter struct {
+	name       string
+	blockCount uint64
+	blockSize  uint64
+
+	slots []*broadcastSlot
+
+	closed uint32
+	done   chan struct{}
+}
+
+type broadcastSlot struct {
+	index int
+	rw    *ReadWriteCloser // duplex: Write is data out, Read is heartbeat in
+
+	// lastSeen is a Unix nanosecond timestamp updated every time a
+	// heartbeat is read from this slot. Accessed atomically.
+	lastSeen int64
+}
+
+func broadcastSlotName(name string, i int) string {
+	return fmt.Sprintf("%s.%d", name, i)
+}
+
+func broadcastClaimName(name string, i int) string {
+	return fmt.Sprintf("%s.%d.claim", name, i)
+}
+
+// CreateBroadcast creates a broadcast channel backed by name, with room for
+// up to maxReaders concurrent OpenBroadcastReader attachments, each with
+// its own blockCount-block ring of blockSize.
+func CreateBroadcast(name string, blockCount, blockSize uint64, maxReaders int) (*BroadcastWriter, error) {
+	if maxReaders <= 0 {
+		return nil, ErrInvalidBlockIndex
+	}
+
+	w := &BroadcastWriter{
+		name:       name,
+		blockCount: blockCount,
+		blockSize:  blockSize,
+		slots:      make([]*broadcastSlot, maxReaders),
+		done:       make(chan struct{}),
+	}
+
+	for i := range w.slots {
+		rw, err := CreateDuplex(broadcastSlotName(name, i), blockCount, blockSize)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+
+		slot := &broadcastSlot{index: i, rw: rw}
+		w.slots[i] = slot
+
+		go w.readHeartbeats(slot)
+	}
+
+	go w.reapStale()
+
+	return w, nil
+}
+
+func (w *BroadcastWriter) readHeartbeats(slot *broadcastSlot) {
+	var ping [1]byte
+
+	for {
+		if _, err := slot.rw.Read(ping[:]); err != nil {
+			return
+		}
+
+		atomic.StoreInt64(&slot.lastSeen, time.Now().UnixNano())
+	}
+}
+
+// reapStale unlinks the claim marker of any slot that hasn't heartbeated
+// within broadcastStaleAfter, letting a new reader attach in its place,
+// and resets its lastSeen back to zero so Broadcast goes back to treating
+// it as unclaimed instead of spending broadcastSendTimeout on it every
+// call forever. The crashed reader's own mapping, if it ever comes back,
+// keeps working against the ring until it next unmaps it.
+func (w *BroadcastWriter) reapStale() {
+	ticker := time.NewTicker(broadcastHeartbeatEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UnixNano()
+
+		for _, slot := range w.slots {
+			w.reapIfStale(slot, now)
+		}
+	}
+}
+
+// reapIfStale unlinks slot's claim marker and resets its lastSeen to zero
+// if it hasn't heartbeated within broadcastStaleAfter of now. Split out of
+// reapStale's loop so the staleness decision can be exercised without a
+// running writer.
+func (w *BroadcastWriter) reapIfStale(slot *broadcastSlot, now int64) {
+	last := atomic.LoadInt64(&slot.lastSeen)
+	if last == 0 || time.Duration(now-last) <= broadcastStaleAfter {
+		return
+	}
+
+	Unlink(broadcastClaimName(w.name, slot.index))
+	atomic.CompareAndSwapInt64(&slot.lastSeen, last, 0)
+}
+
+// Broadcast publishes p to every currently attached and responsive reader.
+// A slot whose reader has fallen behind or stopped heartbeating is skipped
+// for this call rather than blocking the whole broadcast; it catches up,
+// or is eventually reaped, on its own.
+func (w *BroadcastWriter) Broadcast(p []byte) error {
+	for _, slot := range w.slots {
+		if atomic.LoadInt64(&slot.lastSeen) == 0 {
+			continue // never claimed
+		}
+
+		slot.rw.SetWriteDeadline(time.Now().Add(broadcastSendTimeout))
+
+		if err := writeBlock(slot.rw, p); err != nil {
+			continue
+		}
+	}
+
+	return nil
+}
+
+// writeBlock sends p as a single block on rw without marking it as the
+// end of the stream. ReadWriteCloser.Write always sets the EOF flag,
+// which suits a caller sending one complete message per Write but is wrong
+// here: both broadcast data and heartbeats are an ongoing sequence of
+// blocks on a long-lived connection, and an EOF flag on the first block
+// would make any reader that loops on Read until io.EOF (io.Copy,
+// net/http bodies, ...) stop dead after that one block.
+func writeBlock(rw *ReadWriteCloser, p []byte) error {
+	buf, err := rw.GetWriteBuffer()
+	if err != nil {
+		return err
+	}
+
+	n := copy(buf.Data[:cap(buf.Data)], p)
+	buf.Data = buf.Data[:n]
+	buf.Flags[eofFlagIndex] &^= eofFlagMask
+
+	_, err = rw.SendWriteBuffer(buf)
+	return err
+}
+
+// Close closes every reader slot's ring and stops the stale-slot reaper.
+func (w *BroadcastWriter) Close() error {
+	if !atomic.CompareAndSwapUint32(&w.closed, 0, 1) {
+		return nil
+	}
+
+	close(w.done)
+
+	var err error
+	for _, slot := range w.slots {
+		if slot == nil {
+			continue
+		}
+
+		if cerr := slot.rw.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+
+		slot.rw.Unlink()
+	}
+
+	return err
+}
+
+// BroadcastReader is one reader's independent attachment to a broadcast
+// created with CreateBroadcast.
+type BroadcastReader struct {
+	rw    *ReadWriteCloser
+	slot  int
+	claim string
+
+	done chan struct{}
+}
+
+// OpenBroadcastReader claims the next free reader slot of the broadcast
+// named name and attaches to it. It returns ErrNoFreeBroadcastSlot once it
+// reaches a slot index the writer never created, meaning every slot the
+// writer offers is already claimed.
+func OpenBroadcastReader(name string) (*BroadcastReader, error) {
+	for i := 0; ; i++ {
+		claimName := broadcastClaimName(name, i)
+
+		claim, err := CreateSimplex(claimName, 1, 64)
+		if err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		rw, err := OpenDuplex(broadcastSlotName(name, i))
+		if err != nil {
+			claim.Close()
+			Unlink(claimName)
+
+			if os.IsNotExist(err) {
+				return nil, ErrNoFreeBroadcastSlot
+			}
+
+			return nil, err
+		}
+
+		r := &BroadcastReader{rw: rw, slot: i, claim: claimName, done: make(chan struct{})}
+		go r.sendHeartbeats()
+
+		return r, nil
+	}
+}
+
+// sendHeartbeats sends an immediate heartbeat as soon as the reader
+// attaches, then one every broadcastHeartbeatEvery/2 after that. The
+// immediate ping matters: Broadcast treats lastSeen == 0 as "never
+// claimed" and skips the slot, so without it a freshly attached reader
+// would miss every block sent before its first ticked heartbeat.
+func (r *BroadcastReader) sendHeartbeats() {
+	ticker := time.NewTicker(broadcastHeartbeatEvery / 2)
+	defer ticker.Stop()
+
+	var ping [1]byte
+
+	for {
+		if err := writeBlock(r.rw, ping[:]); err != nil {
+			return
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Read reads the next broadcast block for this reader.
+func (r *BroadcastReader) Read(p []byte) (int, error) {
+	return r.rw.Read(p)
+}
+
+// Close detaches from the broadcast, freeing the slot for another reader.
+func (r *BroadcastReader) Close() error {
+	close(r.done)
+
+	err := r.rw.Close()
+	Unlink(r.claim)
+
+	return err
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestReapIfStaleResetsLastSeen(t *testing.T) {
+	w := &BroadcastWriter{name: "test-broadcast"}
+	slot := &broadcastSlot{index: 0}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&slot.lastSeen, now-int64(broadcastStaleAfter)-1)
+
+	w.reapIfStale(slot, now)
+
+	if got := atomic.LoadInt64(&slot.lastSeen); got != 0 {
+		t.Fatalf("lastSeen = %d after reaping a stale slot, want 0", got)
+	}
+}
+
+func TestReapIfStaleLeavesFreshSlotAlone(t *testing.T) {
+	w := &BroadcastWriter{name: "test-broadcast"}
+	slot := &broadcastSlot{index: 0}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&slot.lastSeen, now)
+
+	w.reapIfStale(slot, now)
+
+	if got := atomic.LoadInt64(&slot.lastSeen); got != now {
+		t.Fatalf("lastSeen = %d after reaping a fresh slot, want unchanged %d", got, now)
+	}
+}
+
+func TestReapIfStaleIgnoresUnclaimedSlot(t *testing.T) {
+	w := &BroadcastWriter{name: "test-broadcast"}
+	slot := &broadcastSlot{index: 0}
+
+	w.reapIfStale(slot, time.Now().UnixNano())
+
+	if got := atomic.LoadInt64(&slot.lastSeen); got != 0 {
+		t.Fatalf("lastSeen = %d for a never-claimed slot, want 0", got)
+	}
+}
+
+// newLoopbackRing builds a minimal blockCount-block ring in plain Go
+// memory, good enough to drive GetWriteBuffer/SendWriteBuffer and
+// GetReadBuffer/SendReadBuffer against each other in-process, without a
+// real CreateDuplex/CreateSimplex (which this tree can't build - no
+// structs.h, no generated shared_linux_{386,amd64}.go).
+func newLoopbackRing(t *testing.T, blockCount, blockSize uint64) *ReadWriteCloser {
+	t.Helper()
+
+	full := int(blockHeaderSize) + int(blockSize)
+	raw := make([]byte, int(sharedHeaderSize)+full*int(blockCount+1))
+
+	mem := (*sharedMem)(unsafe.Pointer(&raw[0]))
+	mem.BlockCount = blockCount
+	mem.BlockSize = blockSize
+
+	blocks := uintptr(unsafe.Pointer(mem)) + sharedHeaderSize
+	for i := uint64(0); i <= blockCount; i++ {
+		block := (*sharedBlock)(unsafe.Pointer(blocks + uintptr(i)*uintptr(full)))
+		block.Next = uint32((i + 1) % (blockCount + 1))
+		block.Prev = uint32((i + blockCount) % (blockCount + 1))
+	}
+
+	return &ReadWriteCloser{readShared: mem, writeShared: mem, fullBlockSize: uint64(full)}
+}
+
+func TestWriteBlockClearsEOFAndRoundTrips(t *testing.T) {
+	rw := newLoopbackRing(t, 1, 64)
+
+	want := []byte("broadcast payload")
+	if err := writeBlock(rw, want); err != nil {
+		t.Fatalf("writeBlock: %v", err)
+	}
+
+	buf, err := rw.GetReadBuffer()
+	if err != nil {
+		t.Fatalf("GetReadBuffer: %v", err)
+	}
+
+	if string(buf.Data) != string(want) {
+		t.Fatalf("Data = %q, want %q", buf.Data, want)
+	}
+
+	if buf.Flags[eofFlagIndex]&eofFlagMask != 0 {
+		t.Fatal("writeBlock left the EOF flag set; a reader looping until io.EOF would stop after this one block")
+	}
+}
@@ -11,4 +11,8 @@ var (
 	ErrNotMultipleOf64   = errors.New("blockSize is not a multiple of 64")
 	ErrInvalidBlockIndex = errors.New("invalid block index")
 	ErrInvalidBuffer     = errors.New("invalid buffer")
+
+	// ErrAuthFailed is returned by an AEADReadWriteCloser when a block's
+	// authentication tag does not verify against its ciphertext.
+	ErrAuthFailed = errors.New("shm: message authentication failed")
 )
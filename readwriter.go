@@ -6,12 +6,14 @@
 package shm
 
 import (
+	"context"
 	"golang.org/x/sys/unix"
 	"io"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
-
-	"github.com/tmthrgd/go-sem"
 )
 
 const (
@@ -20,9 +22,19 @@ const (
 )
 
 type Buffer struct {
-	block *sharedBlock
-	write bool
-
+	block     *sharedBlock
+	index     uint32
+	write     bool
+	blockSize uint64
+
+	sparse    bool
+	sparseLen uint64
+
+	// Data is the buffer's payload. For a Buffer returned sparse (see
+	// IsSparse) it aliases the package-wide zeros() buffer rather than any
+	// block's own shm storage, and callers must treat it as read-only: a
+	// write through it would corrupt every other sparse Buffer currently
+	// or ever handed out.
 	Data  []byte
 	Flags *[blockFlagsSize]byte
 }
@@ -40,6 +52,148 @@ type ReadWriteCloser struct {
 	Flags *[sharedFlagsSize]uint32
 
 	closed uint32
+
+	// Must be accessed using atomic operations. Store the zero time.Time
+	// to clear a deadline.
+	readDeadline, writeDeadline atomic.Value
+
+	// readSignalRelay and writeAvailRelay back the deadline/ctx path of
+	// waitSemaphore's calls on, respectively, SemSignal (read side) and
+	// SemAvail (write side) when built against the POSIX semaphore
+	// fallback; see semRelay. Unused (and free) on the default futex
+	// build.
+	readSignalRelay, writeAvailRelay semRelay
+}
+
+// SetDeadline sets the read and write deadlines associated with rw. It is
+// equivalent to calling both SetReadDeadline and SetWriteDeadline.
+//
+// A deadline is an absolute time after which GetReadBuffer, GetWriteBuffer
+// and the blocking Read/Write/ReadFrom/WriteTo helpers fail with
+// os.ErrDeadlineExceeded instead of blocking forever. A zero value for t
+// means no deadline.
+func (rw *ReadWriteCloser) SetDeadline(t time.Time) error {
+	if err := rw.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return rw.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future GetReadBuffer calls (and the
+// Read/WriteTo helpers built on top of it). A zero value for t means no
+// deadline.
+func (rw *ReadWriteCloser) SetReadDeadline(t time.Time) error {
+	rw.readDeadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future GetWriteBuffer calls (and
+// the Write/ReadFrom helpers built on top of it). A zero value for t means
+// no deadline.
+func (rw *ReadWriteCloser) SetWriteDeadline(t time.Time) error {
+	rw.writeDeadline.Store(t)
+	return nil
+}
+
+func (rw *ReadWriteCloser) loadReadDeadline() time.Time {
+	t, _ := rw.readDeadline.Load().(time.Time)
+	return t
+}
+
+func (rw *ReadWriteCloser) loadWriteDeadline() time.Time {
+	t, _ := rw.writeDeadline.Load().(time.Time)
+	return t
+}
+
+// ctxPollInterval bounds how long waitSemaphore's ctx/relay-based fallback
+// waits between checks of ctx.Err(), for the cases that have no OS-level
+// primitive to fold ctx's cancellation into.
+const ctxPollInterval = 100 * time.Millisecond
+
+// waitSemaphore waits on s, giving up early once deadline elapses or ctx is
+// cancelled. When s supports a real OS-level timed wait - the default
+// futex build does, via FUTEX_WAIT's own timeout - that's used directly,
+// sliced to ctxPollInterval when ctx also needs checking; no goroutine is
+// ever spawned, and nothing is ever left blocked to abandon.
+//
+// The portable POSIX semaphore fallback has no timed-wait primitive of its
+// own, so a deadline/ctx there still runs the real Wait in a background
+// goroutine via relay. Unlike the previous design, that goroutine is never
+// abandoned: relay keeps at most one in flight regardless of how many
+// times a caller gives up and retries (an http.Server repeatedly hitting
+// ReadTimeout on an idle connection, say), and it exits for good as soon
+// as Wait returns an error (in particular, once Close's poison fires).
+func waitSemaphore(relay *semRelay, s waiter, deadline time.Time, ctx context.Context) error {
+	if deadline.IsZero() && ctx == nil {
+		return s.Wait()
+	}
+
+	tw, timed := s.(timedWaiter)
+
+	for {
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		slice := ctxPollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			if ctx == nil || remaining < slice {
+				slice = remaining
+			}
+		}
+
+		var err error
+		if timed {
+			err = tw.WaitTimeout(slice)
+		} else {
+			err = relay.wait(s, slice)
+		}
+
+		if err != os.ErrDeadlineExceeded {
+			return err
+		}
+	}
+}
+
+// semRelay lets a single persistent goroutine own the real blocking Wait
+// on a waiter with no OS-level timed wait, so repeated deadline/ctx
+// expiries reuse that one goroutine instead of abandoning a fresh one
+// every time. A token the relay consumes but that no timed-out caller
+// collects simply sits waiting on ch for the next caller - it is never
+// lost - and the relay goroutine itself exits once Wait returns an error,
+// which is exactly what a poisoned waiter does on Close.
+type semRelay struct {
+	once sync.Once
+	ch   chan error
+}
+
+func (r *semRelay) wait(s waiter, slice time.Duration) error {
+	r.once.Do(func() {
+		r.ch = make(chan error)
+		go func() {
+			for {
+				err := s.Wait()
+				r.ch <- err
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+
+	select {
+	case err := <-r.ch:
+		return err
+	case <-time.After(slice):
+		return os.ErrDeadlineExceeded
+	}
 }
 
 func (rw *ReadWriteCloser) Close() error {
@@ -49,6 +203,21 @@ func (rw *ReadWriteCloser) Close() error {
 
 	// finish all sends before close!
 
+	// Poison every semaphore word so a Wait blocked in getReadBuffer,
+	// getWriteBuffer or AcquireBuffers wakes up instead of hanging
+	// forever; those call sites re-check rw.closed once woken, which
+	// covers the sem.Semaphore fallback too (it has no poison bit of its
+	// own to wake on).
+	if rw.readShared != nil {
+		newWaiter(unsafe.Pointer(&rw.readShared.SemSignal)).poison()
+		newWaiter(unsafe.Pointer(&rw.readShared.SemAvail)).poison()
+	}
+
+	if rw.writeShared != nil {
+		newWaiter(unsafe.Pointer(&rw.writeShared.SemSignal)).poison()
+		newWaiter(unsafe.Pointer(&rw.writeShared.SemAvail)).poison()
+	}
+
 	return unix.Munmap(rw.data)
 }
 
@@ -117,16 +286,34 @@ func (rw *ReadWriteCloser) WriteTo(w io.Writer) (n int64, err error) {
 	}
 }
 
+// GetReadBuffer is equivalent to calling GetReadBufferContext with a nil
+// context; it blocks until data is available or a read deadline set with
+// SetReadDeadline/SetDeadline elapses.
 func (rw *ReadWriteCloser) GetReadBuffer() (Buffer, error) {
+	return rw.getReadBuffer(nil)
+}
+
+// GetReadBufferContext is like GetReadBuffer but also unblocks when ctx is
+// done, returning ctx.Err().
+func (rw *ReadWriteCloser) GetReadBufferContext(ctx context.Context) (Buffer, error) {
+	return rw.getReadBuffer(ctx)
+}
+
+func (rw *ReadWriteCloser) getReadBuffer(ctx context.Context) (Buffer, error) {
 	if atomic.LoadUint32(&rw.closed) != 0 {
 		return Buffer{}, io.ErrClosedPipe
 	}
 
 	var block *sharedBlock
+	var index uint32
 
 	blocks := uintptr(unsafe.Pointer(rw.readShared)) + sharedHeaderSize
 
 	for {
+		if atomic.LoadUint32(&rw.closed) != 0 {
+			return Buffer{}, io.ErrClosedPipe
+		}
+
 		blockIndex := atomic.LoadUint32((*uint32)(&rw.readShared.ReadStart))
 		if blockIndex > uint32(rw.readShared.BlockCount) {
 			return Buffer{}, ErrInvalidSharedMemory
@@ -135,7 +322,8 @@ func (rw *ReadWriteCloser) GetReadBuffer() (Buffer, error) {
 		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
 
 		if blockIndex == atomic.LoadUint32((*uint32)(&rw.readShared.WriteEnd)) {
-			if err := ((*sem.Semaphore)(&rw.readShared.SemSignal)).Wait(); err != nil {
+			sig := newWaiter(unsafe.Pointer(&rw.readShared.SemSignal))
+			if err := waitSemaphore(&rw.readSignalRelay, sig, rw.loadReadDeadline(), ctx); err != nil {
 				return Buffer{}, err
 			}
 
@@ -143,14 +331,29 @@ func (rw *ReadWriteCloser) GetReadBuffer() (Buffer, error) {
 		}
 
 		if atomic.CompareAndSwapUint32((*uint32)(&rw.readShared.ReadStart), blockIndex, uint32(block.Next)) {
+			index = blockIndex
 			break
 		}
 	}
 
-	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
 	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
+
+	if flags[sparseFlagIndex]&sparseFlagMask != 0 {
+		return Buffer{
+			block:     block,
+			index:     index,
+			blockSize: rw.readShared.BlockSize,
+
+			Data:  zeros(block.Size),
+			Flags: flags,
+		}, nil
+	}
+
+	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
 	return Buffer{
-		block: block,
+		block:     block,
+		index:     index,
+		blockSize: rw.readShared.BlockSize,
 
 		Data:  data[:block.Size:rw.readShared.BlockSize],
 		Flags: flags,
@@ -187,7 +390,7 @@ func (rw *ReadWriteCloser) SendReadBuffer(buf Buffer) error {
 		atomic.CompareAndSwapUint32((*uint32)(&rw.readShared.ReadEnd), blockIndex, uint32(block.Next))
 
 		if uint32(block.Prev) == atomic.LoadUint32((*uint32)(&rw.readShared.WriteStart)) {
-			if err := ((*sem.Semaphore)(&rw.readShared.SemAvail)).Post(); err != nil {
+			if err := newWaiter(unsafe.Pointer(&rw.readShared.SemAvail)).Post(); err != nil {
 				return err
 			}
 		}
@@ -222,6 +425,10 @@ func (rw *ReadWriteCloser) ReadFrom(r io.Reader) (n int64, err error) {
 		buf.Data = buf.Data[:nn]
 		n += int64(nn)
 
+		if nn > 0 && isAllZero(buf.Data) {
+			buf.MarkSparse(nn)
+		}
+
 		if err == io.EOF {
 			buf.Flags[eofFlagIndex] |= eofFlagMask
 		} else {
@@ -240,16 +447,34 @@ func (rw *ReadWriteCloser) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 }
 
+// GetWriteBuffer is equivalent to calling GetWriteBufferContext with a nil
+// context; it blocks until space is available or a write deadline set with
+// SetWriteDeadline/SetDeadline elapses.
 func (rw *ReadWriteCloser) GetWriteBuffer() (Buffer, error) {
+	return rw.getWriteBuffer(nil)
+}
+
+// GetWriteBufferContext is like GetWriteBuffer but also unblocks when ctx is
+// done, returning ctx.Err().
+func (rw *ReadWriteCloser) GetWriteBufferContext(ctx context.Context) (Buffer, error) {
+	return rw.getWriteBuffer(ctx)
+}
+
+func (rw *ReadWriteCloser) getWriteBuffer(ctx context.Context) (Buffer, error) {
 	if atomic.LoadUint32(&rw.closed) != 0 {
 		return Buffer{}, io.ErrClosedPipe
 	}
 
 	var block *sharedBlock
+	var index uint32
 
 	blocks := uintptr(unsafe.Pointer(rw.writeShared)) + sharedHeaderSize
 
 	for {
+		if atomic.LoadUint32(&rw.closed) != 0 {
+			return Buffer{}, io.ErrClosedPipe
+		}
+
 		blockIndex := atomic.LoadUint32((*uint32)(&rw.writeShared.WriteStart))
 		if blockIndex > uint32(rw.writeShared.BlockCount) {
 			return Buffer{}, ErrInvalidSharedMemory
@@ -258,7 +483,8 @@ func (rw *ReadWriteCloser) GetWriteBuffer() (Buffer, error) {
 		block = (*sharedBlock)(unsafe.Pointer(blocks + uintptr(uint64(blockIndex)*rw.fullBlockSize)))
 
 		if uint32(block.Next) == atomic.LoadUint32((*uint32)(&rw.writeShared.ReadEnd)) {
-			if err := ((*sem.Semaphore)(&rw.writeShared.SemAvail)).Wait(); err != nil {
+			avail := newWaiter(unsafe.Pointer(&rw.writeShared.SemAvail))
+			if err := waitSemaphore(&rw.writeAvailRelay, avail, rw.loadWriteDeadline(), ctx); err != nil {
 				return Buffer{}, err
 			}
 
@@ -266,6 +492,7 @@ func (rw *ReadWriteCloser) GetWriteBuffer() (Buffer, error) {
 		}
 
 		if atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteStart), blockIndex, uint32(block.Next)) {
+			index = blockIndex
 			break
 		}
 	}
@@ -273,8 +500,10 @@ func (rw *ReadWriteCloser) GetWriteBuffer() (Buffer, error) {
 	data := (*[1 << 30]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(block)) + blockHeaderSize))
 	flags := (*[len(block.Flags)]byte)(unsafe.Pointer(&block.Flags[0]))
 	return Buffer{
-		block: block,
-		write: true,
+		block:     block,
+		index:     index,
+		write:     true,
+		blockSize: rw.writeShared.BlockSize,
 
 		Data:  data[:0:rw.writeShared.BlockSize],
 		Flags: flags,
@@ -292,7 +521,13 @@ func (rw *ReadWriteCloser) SendWriteBuffer(buf Buffer) (n int, err error) {
 
 	block := buf.block
 
-	*(*uint64)(&block.Size) = uint64(len(buf.Data))
+	if buf.sparse {
+		*(*uint64)(&block.Size) = buf.sparseLen
+		buf.Flags[sparseFlagIndex] |= sparseFlagMask
+	} else {
+		*(*uint64)(&block.Size) = uint64(len(buf.Data))
+		buf.Flags[sparseFlagIndex] &^= sparseFlagMask
+	}
 
 	atomic.StoreUint32((*uint32)(&block.DoneWrite), 1)
 
@@ -313,7 +548,7 @@ func (rw *ReadWriteCloser) SendWriteBuffer(buf Buffer) (n int, err error) {
 		atomic.CompareAndSwapUint32((*uint32)(&rw.writeShared.WriteEnd), blockIndex, uint32(block.Next))
 
 		if blockIndex == atomic.LoadUint32((*uint32)(&rw.writeShared.ReadStart)) {
-			if err := ((*sem.Semaphore)(&rw.writeShared.SemSignal)).Post(); err != nil {
+			if err := newWaiter(unsafe.Pointer(&rw.writeShared.SemSignal)).Post(); err != nil {
 				return len(buf.Data), err
 			}
 		}
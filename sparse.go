@@ -0,0 +1,82 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	sparseFlagIndex = 0
+	sparseFlagMask  = 0x04
+)
+
+// MarkSparse marks buf as representing n logical bytes of zeros without
+// requiring the shm payload to be written at all: SendWriteBuffer records n
+// as the block's size and sets SparseFlag, but never touches the block's
+// data area. n must not exceed the block size.
+func (buf *Buffer) MarkSparse(n int) {
+	buf.sparse = true
+	buf.sparseLen = uint64(n)
+	buf.Data = buf.Data[:0]
+}
+
+// IsSparse reports whether buf was received as a sparse block: one whose
+// Data is a lazily materialized zero slice rather than a view into the
+// block's shm payload.
+func (buf *Buffer) IsSparse() bool {
+	return buf.Flags[sparseFlagIndex]&sparseFlagMask != 0
+}
+
+// isAllZero reports whether p is entirely zero. p's length should be a
+// multiple of 64, the same invariant ErrNotMultipleOf64 already enforces on
+// blockSize, so the inner loop can OR together whole 64-byte lanes instead
+// of testing byte by byte.
+func isAllZero(p []byte) bool {
+	for len(p) >= 64 {
+		var acc uint64
+		for i := 0; i < 64; i += 8 {
+			acc |= binary.LittleEndian.Uint64(p[i : i+8])
+		}
+
+		if acc != 0 {
+			return false
+		}
+
+		p = p[64:]
+	}
+
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// zeroBlock is a lazily grown, read-only buffer of zeros shared by every
+// sparse Buffer's Data, so materializing a sparse block's logical length
+// never needs to touch the shm mapping itself.
+var zeroBlock unsafe.Pointer // *[]byte, accessed via atomic.LoadPointer/StorePointer
+
+// zeros returns a slice of n zero bytes backed by the process-wide shared
+// zeroBlock. Every sparse Buffer's Data aliases the same backing array, so
+// the returned slice must only ever be read, never written through: a
+// caller that wrote to it would corrupt every other sparse Buffer current
+// or future callers hand out, including ones for unrelated blocks and
+// unrelated ReadWriteClosers.
+func zeros(n uint64) []byte {
+	if p := (*[]byte)(atomic.LoadPointer(&zeroBlock)); p != nil && uint64(len(*p)) >= n {
+		return (*p)[:n]
+	}
+
+	buf := make([]byte, n)
+	atomic.StorePointer(&zeroBlock, unsafe.Pointer(&buf))
+	return buf
+}
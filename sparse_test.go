@@ -0,0 +1,99 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import "testing"
+
+func TestIsAllZero(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		want bool
+	}{
+		{"empty", nil, true},
+		{"short all zero", make([]byte, 10), true},
+		{"short with one set byte", []byte{0, 0, 0, 1, 0}, false},
+		{"exactly one lane all zero", make([]byte, 64), true},
+		{"exactly one lane with set byte", func() []byte {
+			p := make([]byte, 64)
+			p[63] = 1
+			return p
+		}(), false},
+		{"multiple lanes, tail set", func() []byte {
+			p := make([]byte, 130)
+			p[129] = 1
+			return p
+		}(), false},
+		{"multiple lanes all zero", make([]byte, 130), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAllZero(tt.p); got != tt.want {
+				t.Errorf("isAllZero(len=%d) = %v, want %v", len(tt.p), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZerosGrowsAndReusesTheSharedBuffer(t *testing.T) {
+	small := zeros(8)
+	if len(small) != 8 {
+		t.Fatalf("len(zeros(8)) = %d, want 8", len(small))
+	}
+	for _, b := range small {
+		if b != 0 {
+			t.Fatalf("zeros(8) returned a non-zero byte")
+		}
+	}
+
+	large := zeros(4096)
+	if len(large) != 4096 {
+		t.Fatalf("len(zeros(4096)) = %d, want 4096", len(large))
+	}
+
+	// A second request no larger than the now-grown shared buffer must be
+	// served from it rather than allocating again.
+	again := zeros(4096)
+	if &again[0] != &large[0] {
+		t.Fatalf("zeros(4096) did not reuse the buffer grown by the previous call")
+	}
+}
+
+func TestBufferMarkSparseAndIsSparse(t *testing.T) {
+	var flags [blockFlagsSize]byte
+	buf := Buffer{
+		Data:  make([]byte, 0, 64),
+		Flags: &flags,
+	}
+
+	if buf.IsSparse() {
+		t.Fatal("IsSparse is true before SparseFlag is set")
+	}
+
+	buf.MarkSparse(48)
+
+	if buf.sparseLen != 48 {
+		t.Fatalf("sparseLen = %d, want 48", buf.sparseLen)
+	}
+
+	if len(buf.Data) != 0 {
+		t.Fatalf("len(Data) = %d after MarkSparse, want 0", len(buf.Data))
+	}
+
+	// MarkSparse itself only records the pending state; SendWriteBuffer is
+	// what sets SparseFlag on the shared Flags, so IsSparse is still false
+	// until that happens.
+	if buf.IsSparse() {
+		t.Fatal("IsSparse is true before SendWriteBuffer sets SparseFlag")
+	}
+
+	flags[sparseFlagIndex] |= sparseFlagMask
+
+	if !buf.IsSparse() {
+		t.Fatal("IsSparse is false after SparseFlag is set")
+	}
+}
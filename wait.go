@@ -0,0 +1,44 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import "time"
+
+// waiter is the cross-process blocking primitive used to signal that a
+// ring has transitioned empty→non-empty or full→non-full. newWaiter turns
+// the raw shared memory backing a SemSignal/SemAvail field into one;
+// wait_futex.go provides the default, syscall-light implementation on
+// Linux, and wait_sem.go is the portable POSIX semaphore fallback used
+// everywhere else (and on Linux when built with the shm_nofutex tag).
+//
+// newWaiter must only be called with the address of a shared SemSignal or
+// SemAvail field; both implementations keep their view of that memory
+// within the existing sem_t-sized reservation, so the shared header's
+// layout is the same in both build modes. The word's contents are encoded
+// differently by each, so both peers of a channel use the same build mode.
+type waiter interface {
+	Wait() error
+	Post() error
+
+	// poison wakes every Wait currently blocked on this waiter.
+	// ReadWriteCloser.Close calls this on every semaphore word it owns. On
+	// futexWaiter every future Wait then returns io.ErrClosedPipe instead
+	// of blocking; semWaiter has no poison bit, so poison only posts
+	// semPoisonPosts tokens, the Waits they wake return nil, and callers
+	// re-check ReadWriteCloser.closed to notice the close.
+	poison()
+}
+
+// timedWaiter is implemented by a waiter that can give up on its own, at
+// the OS level, once timeout elapses, returning os.ErrDeadlineExceeded.
+// futexWaiter implements it directly on top of FUTEX_WAIT's own timeout
+// argument, so waitSemaphore never needs to run Wait in a goroutine it
+// can't get back for the common Linux build. semWaiter does not implement
+// it: the POSIX sem_t this package wraps has no timed-wait entry point of
+// its own.
+type timedWaiter interface {
+	WaitTimeout(timeout time.Duration) error
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// +build linux,!shm_nofutex
+
+package shm
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// futexWaiter turns the first 4 bytes of a shared SemSignal/SemAvail
+// field (otherwise a POSIX sem_t) into a futex word, so Wait/Post stay on
+// a lock-free CAS path whenever the ring has already transitioned and only
+// fall back to FUTEX_WAIT/FUTEX_WAKE for the genuinely blocking case. The
+// remaining bytes of the sem_t reservation are left untouched.
+//
+// Every futex(2) call below operates on the shared (non-private) futex
+// path: the word lives in a POSIX shared memory mapping visited by more
+// than one process, and FUTEX_PRIVATE_FLAG is keyed on a single process's
+// mm, so a Post in one process would never wake a Wait in another.
+//
+// The word packs a 16-bit token count in its low bits and a 15-bit
+// generation counter above it; Post always bumps the generation, so a
+// Wait that reloads the word after losing a race with a concurrent
+// Post+Wait pair sees a different value and retries instead of sleeping
+// on state that's already stale (the classic futex ABA/lost-wakeup bug).
+// The top bit marks the waiter as poisoned by Close, waking every blocked
+// waiter and making future Waits return immediately.
+type futexWaiter uint32
+
+const (
+	futexCountMask = 0x0000ffff
+	futexGenStep   = 1 << 16
+	futexGenMask   = 0x7fff0000
+	futexPoisoned  = 1 << 31
+)
+
+func newWaiter(mem unsafe.Pointer) waiter {
+	return (*futexWaiter)(mem)
+}
+
+func (f *futexWaiter) word() *uint32 {
+	return (*uint32)(unsafe.Pointer(f))
+}
+
+func (f *futexWaiter) Wait() error {
+	for {
+		old := atomic.LoadUint32(f.word())
+		if old&futexPoisoned != 0 {
+			return io.ErrClosedPipe
+		}
+
+		if old&futexCountMask != 0 {
+			if atomic.CompareAndSwapUint32(f.word(), old, old-1) {
+				return nil
+			}
+
+			continue
+		}
+
+		_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(f)),
+			unix.FUTEX_WAIT, uintptr(old), 0, 0, 0)
+		if errno != 0 && errno != unix.EAGAIN && errno != unix.EINTR {
+			return errno
+		}
+	}
+}
+
+// WaitTimeout is like Wait, but passes timeout straight through to
+// FUTEX_WAIT so the kernel itself aborts the wait at the deadline: nothing
+// is left blocked to abandon, unlike spawning Wait in a goroutine and
+// giving up on the result.
+func (f *futexWaiter) WaitTimeout(timeout time.Duration) error {
+	for {
+		old := atomic.LoadUint32(f.word())
+		if old&futexPoisoned != 0 {
+			return io.ErrClosedPipe
+		}
+
+		if old&futexCountMask != 0 {
+			if atomic.CompareAndSwapUint32(f.word(), old, old-1) {
+				return nil
+			}
+
+			continue
+		}
+
+		if timeout <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		ts := unix.NsecToTimespec(timeout.Nanoseconds())
+		start := time.Now()
+
+		_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(f)),
+			unix.FUTEX_WAIT, uintptr(old), uintptr(unsafe.Pointer(&ts)), 0, 0)
+		switch errno {
+		case unix.ETIMEDOUT:
+			return os.ErrDeadlineExceeded
+		case 0, unix.EAGAIN, unix.EINTR:
+			timeout -= time.Since(start)
+		default:
+			return errno
+		}
+	}
+}
+
+func (f *futexWaiter) Post() error {
+	for {
+		old := atomic.LoadUint32(f.word())
+		if old&futexPoisoned != 0 {
+			return nil
+		}
+
+		count := old & futexCountMask
+		if count < futexCountMask {
+			count++
+		}
+
+		next := ((old + futexGenStep) & futexGenMask) | count
+		if atomic.CompareAndSwapUint32(f.word(), old, next) {
+			break
+		}
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(f)),
+		unix.FUTEX_WAKE, 1, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// poison marks f so every currently blocked Wait returns io.ErrClosedPipe
+// and no future Wait blocks at all. Close calls this on every one of a
+// ReadWriteCloser's semaphore words.
+func (f *futexWaiter) poison() {
+	for {
+		old := atomic.LoadUint32(f.word())
+		if old&futexPoisoned != 0 {
+			return
+		}
+
+		if atomic.CompareAndSwapUint32(f.word(), old, old|futexPoisoned) {
+			break
+		}
+	}
+
+	unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(f)),
+		unix.FUTEX_WAKE, 1<<30, 0, 0, 0)
+}
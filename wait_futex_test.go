@@ -0,0 +1,84 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// +build linux,!shm_nofutex
+
+package shm
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func newTestFutexWaiter() *futexWaiter {
+	var word uint32
+	return (*futexWaiter)(unsafe.Pointer(&word))
+}
+
+func TestFutexWaiterFastPath(t *testing.T) {
+	f := newTestFutexWaiter()
+
+	if err := f.Post(); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+
+	if err := f.Wait(); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	if *f.word()&futexCountMask != 0 {
+		t.Fatalf("token count = %d, want 0 after a matched Post/Wait", *f.word()&futexCountMask)
+	}
+}
+
+func TestFutexWaiterWaitTimeoutExpires(t *testing.T) {
+	f := newTestFutexWaiter()
+
+	start := time.Now()
+	if err := f.WaitTimeout(20 * time.Millisecond); err != os.ErrDeadlineExceeded {
+		t.Fatalf("WaitTimeout = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("WaitTimeout returned after %v, want at least 20ms", elapsed)
+	}
+}
+
+func TestFutexWaiterWaitTimeoutConsumesAPost(t *testing.T) {
+	f := newTestFutexWaiter()
+
+	if err := f.Post(); err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+
+	if err := f.WaitTimeout(time.Second); err != nil {
+		t.Fatalf("WaitTimeout: %v", err)
+	}
+
+	if *f.word()&futexCountMask != 0 {
+		t.Fatalf("token count = %d, want 0 after WaitTimeout consumed a Post", *f.word()&futexCountMask)
+	}
+}
+
+func TestFutexWaiterPoison(t *testing.T) {
+	f := newTestFutexWaiter()
+
+	f.poison()
+
+	if err := f.Wait(); err != io.ErrClosedPipe {
+		t.Fatalf("Wait after poison = %v, want io.ErrClosedPipe", err)
+	}
+
+	if err := f.Post(); err != nil {
+		t.Fatalf("Post after poison returned an error: %v", err)
+	}
+
+	if *f.word()&futexCountMask != 0 {
+		t.Fatalf("Post after poison must not leave a token behind, got count %d", *f.word()&futexCountMask)
+	}
+}
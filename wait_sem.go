@@ -0,0 +1,48 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+// +build !linux shm_nofutex
+
+package shm
+
+import (
+	"unsafe"
+
+	"github.com/tmthrgd/go-sem"
+)
+
+// semWaiter is sem.Semaphore with a poison method grafted on: sem.Semaphore
+// is defined in another package, so the only way to give it one is a named
+// type over the same underlying memory.
+type semWaiter sem.Semaphore
+
+// semPoisonPosts is how many tokens poison posts to wake blocked waiters. A
+// POSIX semaphore has no spare bit to carry a poison flag the way the
+// futex word does, so every getReadBuffer/getWriteBuffer/AcquireBuffers
+// loop re-checks ReadWriteCloser.closed once woken instead of relying on
+// Wait itself to report the close.
+const semPoisonPosts = 1 << 10
+
+func newWaiter(mem unsafe.Pointer) waiter {
+	return (*semWaiter)(mem)
+}
+
+func (w *semWaiter) sem() *sem.Semaphore {
+	return (*sem.Semaphore)(w)
+}
+
+func (w *semWaiter) Wait() error {
+	return w.sem().Wait()
+}
+
+func (w *semWaiter) Post() error {
+	return w.sem().Post()
+}
+
+func (w *semWaiter) poison() {
+	for i := 0; i < semPoisonPosts; i++ {
+		w.sem().Post()
+	}
+}
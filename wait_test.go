@@ -0,0 +1,135 @@
+// Copyright 2016 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package shm
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWaiter is a plain, in-process stand-in for a waiter backed by real
+// shared memory, so waitSemaphore's relay fallback can be exercised
+// without a real semaphore or futex word. It deliberately has no
+// WaitTimeout method, so waitSemaphore always takes the semRelay path for
+// it, regardless of which build tag this test runs under.
+type fakeWaiter struct {
+	mu      sync.Mutex
+	tokens  int
+	waiters []chan struct{}
+}
+
+func (f *fakeWaiter) Post() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.waiters) > 0 {
+		w := f.waiters[0]
+		f.waiters = f.waiters[1:]
+		close(w)
+		return nil
+	}
+
+	f.tokens++
+	return nil
+}
+
+func (f *fakeWaiter) Wait() error {
+	f.mu.Lock()
+	if f.tokens > 0 {
+		f.tokens--
+		f.mu.Unlock()
+		return nil
+	}
+
+	w := make(chan struct{})
+	f.waiters = append(f.waiters, w)
+	f.mu.Unlock()
+
+	<-w
+	return nil
+}
+
+func (f *fakeWaiter) poison() {}
+
+func TestWaitSemaphoreDeadlineDoesNotLoseAConcurrentPost(t *testing.T) {
+	f := &fakeWaiter{}
+	var relay semRelay
+
+	deadline := time.Now().Add(20 * time.Millisecond)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- waitSemaphore(&relay, f, deadline, nil)
+	}()
+
+	// Post racing the deadline: whichever side waitSemaphore's own Wait
+	// actually consumes, no token may end up permanently stuck.
+	time.Sleep(20 * time.Millisecond)
+	f.Post()
+
+	// Either outcome (timed out, or got the Post first) is fine; what
+	// matters is that the real Post is never lost, checked below.
+	<-errc
+
+	// Whether waitSemaphore reported a timeout or a real wakeup, a
+	// subsequent Wait must see the Post exactly once: either immediately
+	// (the relay already has it buffered) or soon after (the relay's
+	// persistent goroutine picks it up and delivers it here).
+	done := make(chan struct{})
+	go func() {
+		relay.wait(f, time.Second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Post was lost: a later wait never woke up")
+	}
+}
+
+// countingWaiter counts how many times Wait has ever been called on it, so
+// a test can tell a relay's background goroutine was started at most once
+// rather than once per expiry.
+type countingWaiter struct {
+	fakeWaiter
+	waitCalls int32
+}
+
+func (c *countingWaiter) Wait() error {
+	atomic.AddInt32(&c.waitCalls, 1)
+	return c.fakeWaiter.Wait()
+}
+
+// TestWaitSemaphoreRelayReusesOneGoroutine exercises the scenario the
+// relay fallback exists for: a caller that repeatedly hits a short
+// deadline with no data (an http.Server's ReadTimeout/IdleTimeout on an
+// idle connection) must not accumulate one abandoned goroutine per
+// expiry - every timed-out call reuses the same relay, and only ever one
+// background Wait is ever in flight for it.
+func TestWaitSemaphoreRelayReusesOneGoroutine(t *testing.T) {
+	f := &countingWaiter{}
+	var relay semRelay
+
+	deadline := 5 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		err := waitSemaphore(&relay, f, time.Now().Add(deadline), nil)
+		if err != os.ErrDeadlineExceeded {
+			t.Fatalf("call %d: err = %v, want os.ErrDeadlineExceeded", i, err)
+		}
+	}
+
+	// The relay's background goroutine calls Wait once, then blocks
+	// forever inside it (no token ever arrives) - every one of the 5
+	// timed-out calls above must have reused that same in-flight Wait
+	// rather than starting its own.
+	if got := atomic.LoadInt32(&f.waitCalls); got != 1 {
+		t.Fatalf("Wait was called %d times across 5 expiries, want 1 (relay should reuse one background goroutine)", got)
+	}
+}